@@ -0,0 +1,90 @@
+package hydra
+
+import (
+	"context"
+
+	"github.com/volatiletech/authboss"
+)
+
+// UserInfoClaimsKey is the context key under which ConsentPost stashes the
+// result of ClaimsProvider.UserInfoClaims before it submits the
+// accept-consent body, so EventHydraBeforeAcceptConsent handlers can read
+// it from the same request. It is not set when ConsentGet skips the
+// consent screen.
+const UserInfoClaimsKey = "hydra_userinfo_claims"
+
+// ClaimsProvider lets a user type control exactly what ends up in the
+// id_token, access_token and userinfo Hydra issues for an authorization,
+// instead of the flat map SessionableUser.GetSession hands over verbatim.
+// When a user implements ClaimsProvider it takes precedence over
+// SessionableUser.
+type ClaimsProvider interface {
+	authboss.User
+
+	IDTokenClaims(ctx context.Context, scopes, audience []string) map[string]interface{}
+	AccessTokenClaims(ctx context.Context, scopes, audience []string) map[string]interface{}
+	UserInfoClaims(ctx context.Context, scopes []string) map[string]interface{}
+}
+
+// sessionPayload builds the Hydra "session" body field for usr, preferring
+// ClaimsProvider when available and falling back to
+// SessionableUser.GetSession for backwards compatibility.
+func sessionPayload(ctx context.Context, usr authboss.User, scopes, audience []string) map[string]interface{} {
+	if cp, ok := usr.(ClaimsProvider); ok {
+		return map[string]interface{}{
+			"id_token":     cp.IDTokenClaims(ctx, scopes, audience),
+			"access_token": cp.AccessTokenClaims(ctx, scopes, audience),
+		}
+	}
+	if sessionable, ok := usr.(SessionableUser); ok {
+		return sessionable.GetSession()
+	}
+	return map[string]interface{}{}
+}
+
+// userInfoClaims returns the claims a /userinfo endpoint should serve for
+// usr, or nil if usr doesn't implement ClaimsProvider.
+func userInfoClaims(ctx context.Context, usr authboss.User, scopes []string) map[string]interface{} {
+	cp, ok := usr.(ClaimsProvider)
+	if !ok {
+		return nil
+	}
+	return cp.UserInfoClaims(ctx, scopes)
+}
+
+// StandardClaims populates the standard OIDC claims (sub, email,
+// email_verified, name, preferred_username) from usr, honoring scopes the
+// same way Hydra's reference consent strategy does: profile-ish claims
+// only appear when their scope was actually granted. It's meant to be
+// called from a ClaimsProvider implementation's IDTokenClaims/
+// UserInfoClaims, not used directly as one.
+func StandardClaims(usr authboss.User, scopes []string) map[string]interface{} {
+	granted := make(map[string]bool, len(scopes))
+	for _, s := range scopes {
+		granted[s] = true
+	}
+
+	claims := map[string]interface{}{
+		"sub": usr.GetPID(),
+	}
+
+	if granted["email"] {
+		if e, ok := usr.(interface{ GetEmail() string }); ok {
+			claims["email"] = e.GetEmail()
+		}
+		if c, ok := usr.(interface{ GetConfirmed() bool }); ok {
+			claims["email_verified"] = c.GetConfirmed()
+		}
+	}
+
+	if granted["profile"] {
+		if n, ok := usr.(interface{ GetName() string }); ok {
+			claims["name"] = n.GetName()
+		}
+		if u, ok := usr.(interface{ GetUsername() string }); ok {
+			claims["preferred_username"] = u.GetUsername()
+		}
+	}
+
+	return claims
+}
@@ -0,0 +1,69 @@
+package hydra
+
+import "net/http"
+
+// hydraBodyKey is the context key under which the raw request body map
+// destined for Hydra (accept-login/accept-consent) is stashed before the
+// EventHydraLoginSkip, EventHydraConsentSkip and EventHydraBeforeAccept*
+// events fire, so handlers can mutate session, grant_scope or
+// grant_access_token_audience before it's submitted. For
+// EventHydraBeforeAcceptLogout the map only carries the challenge and is
+// not sent to Hydra.
+const hydraBodyKey = "hydra_accept_body"
+
+// HydraEventHandler is a hook registered against one of the hydra module's
+// own events via HydraConsent.On. It follows the same handled/error
+// contract as authboss.Events: returning handled=true tells the caller to
+// stop processing the request because the handler already responded.
+type HydraEventHandler func(w http.ResponseWriter, r *http.Request) (bool, error)
+
+// hydraEvent identifies one of the Hydra-flow events below. authboss.Event
+// is a closed enum with no way for a module to register new event kinds
+// against the shared authboss.Authboss event bus, so the hydra module
+// keeps its own small per-instance event bus instead.
+type hydraEvent int
+
+const (
+	// EventHydraLoginSkip fires when LoginGet is about to auto-accept a
+	// login challenge because Hydra (or LoginSkipPredicate) says the user
+	// has already authenticated for this client.
+	EventHydraLoginSkip hydraEvent = iota
+	// EventHydraConsentSkip fires when ConsentGet is about to auto-accept
+	// a consent challenge because Hydra (or ConsentSkipPredicate) says the
+	// client is trusted, or because a stored ConsentGrantStorer grant
+	// already covers the request.
+	EventHydraConsentSkip
+	// EventHydraBeforeAcceptLogin fires immediately before the EventAuth
+	// after-hook submits the accept-login body to Hydra.
+	EventHydraBeforeAcceptLogin
+	// EventHydraBeforeAcceptConsent fires immediately before ConsentPost
+	// submits the accept-consent body to Hydra.
+	EventHydraBeforeAcceptConsent
+	// EventHydraBeforeAcceptLogout fires immediately before LogoutPost
+	// submits the accept-logout request to Hydra.
+	EventHydraBeforeAcceptLogout
+)
+
+// On registers fn to run when ev fires, in registration order, the same
+// way application code hooks authboss.EventAuth/authboss.EventRegister/etc
+// via ab.Events.Before.
+func (a *HydraConsent) On(ev hydraEvent, fn HydraEventHandler) {
+	if a.hydraHandlers == nil {
+		a.hydraHandlers = make(map[hydraEvent][]HydraEventHandler)
+	}
+	a.hydraHandlers[ev] = append(a.hydraHandlers[ev], fn)
+}
+
+// fireHydraEvent runs every handler registered for ev in order, following
+// the same handled/error contract as the rest of the module's event
+// handling: if a handler returns handled=true (or an error) the caller
+// should stop processing the request.
+func (a *HydraConsent) fireHydraEvent(ev hydraEvent, w http.ResponseWriter, r *http.Request) (bool, error) {
+	for _, fn := range a.hydraHandlers[ev] {
+		handled, err := fn(w, r)
+		if err != nil || handled {
+			return handled, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,123 @@
+package hydra
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Grant is a previously-accepted consent grant for a (subject, client)
+// pair. ConsentGet consults it before rendering PageConsent so a user who
+// has already granted a superset of what's being requested isn't
+// re-prompted, mirroring the reference ORY consent strategy's
+// ErrNoPreviousConsentFound path.
+type Grant struct {
+	Subject   string
+	ClientID  string
+	Scopes    []string
+	Audience  []string
+	ExpiresAt time.Time
+}
+
+// ConsentGrantStorer persists consent grants. ConsentPost writes to it
+// after a successful AcceptConsent; ConsentGet reads from it to decide
+// whether the consent screen can be skipped.
+type ConsentGrantStorer interface {
+	SaveGrant(ctx context.Context, subject, clientID string, scopes, audience []string, expiresAt time.Time) error
+	FindGrant(ctx context.Context, subject, clientID string) (*Grant, error)
+	RevokeGrants(ctx context.Context, subject string) error
+}
+
+// MemoryConsentGrantStorer is an in-memory ConsentGrantStorer suitable for
+// development and tests. Production deployments should back
+// ConsentGrantStorer with SQL the same way authboss's other storers are
+// typically backed.
+type MemoryConsentGrantStorer struct {
+	mu     sync.Mutex
+	grants map[string]*Grant
+}
+
+// NewMemoryConsentGrantStorer returns an empty MemoryConsentGrantStorer.
+func NewMemoryConsentGrantStorer() *MemoryConsentGrantStorer {
+	return &MemoryConsentGrantStorer{grants: make(map[string]*Grant)}
+}
+
+func grantKey(subject, clientID string) string {
+	return subject + "|" + clientID
+}
+
+// SaveGrant implements ConsentGrantStorer.
+func (m *MemoryConsentGrantStorer) SaveGrant(ctx context.Context, subject, clientID string, scopes, audience []string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.grants[grantKey(subject, clientID)] = &Grant{
+		Subject:   subject,
+		ClientID:  clientID,
+		Scopes:    scopes,
+		Audience:  audience,
+		ExpiresAt: expiresAt,
+	}
+	return nil
+}
+
+// FindGrant implements ConsentGrantStorer.
+func (m *MemoryConsentGrantStorer) FindGrant(ctx context.Context, subject, clientID string) (*Grant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	grant, ok := m.grants[grantKey(subject, clientID)]
+	if !ok {
+		return nil, nil
+	}
+	return grant, nil
+}
+
+// RevokeGrants implements ConsentGrantStorer.
+func (m *MemoryConsentGrantStorer) RevokeGrants(ctx context.Context, subject string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, grant := range m.grants {
+		if grant.Subject == subject {
+			delete(m.grants, key)
+		}
+	}
+	return nil
+}
+
+func stringsContainAll(superset, subset []string) bool {
+	have := make(map[string]bool, len(superset))
+	for _, s := range superset {
+		have[s] = true
+	}
+	for _, s := range subset {
+		if !have[s] {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *Grant) covers(scopes, audience []string) bool {
+	if g == nil || g.ExpiresAt.Before(time.Now()) {
+		return false
+	}
+	return stringsContainAll(g.Scopes, scopes) && stringsContainAll(g.Audience, audience)
+}
+
+// ConsentRevokePost deletes every stored grant for the currently
+// authenticated subject so their next authorization request forces a
+// fresh consent prompt.
+func (a *HydraConsent) ConsentRevokePost(w http.ResponseWriter, r *http.Request) error {
+	if a.cfg.ConsentGrantStorer == nil {
+		return nil
+	}
+
+	subject, err := a.Authboss.CurrentUserID(r)
+	if err != nil {
+		return err
+	}
+	return a.cfg.ConsentGrantStorer.RevokeGrants(r.Context(), subject)
+}
@@ -0,0 +1,109 @@
+package hydra
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStringsContainAll(t *testing.T) {
+	tests := []struct {
+		name     string
+		superset []string
+		subset   []string
+		want     bool
+	}{
+		{"empty subset", []string{"a", "b"}, nil, true},
+		{"exact match", []string{"a", "b"}, []string{"a", "b"}, true},
+		{"subset of superset", []string{"a", "b", "c"}, []string{"b"}, true},
+		{"missing element", []string{"a", "b"}, []string{"a", "c"}, false},
+		{"empty superset, nonempty subset", nil, []string{"a"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stringsContainAll(tt.superset, tt.subset); got != tt.want {
+				t.Errorf("stringsContainAll(%v, %v) = %v, want %v", tt.superset, tt.subset, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGrantCovers(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name     string
+		grant    *Grant
+		scopes   []string
+		audience []string
+		want     bool
+	}{
+		{
+			name:     "nil grant",
+			grant:    nil,
+			scopes:   []string{"openid"},
+			audience: nil,
+			want:     false,
+		},
+		{
+			name:     "expired grant",
+			grant:    &Grant{Scopes: []string{"openid"}, ExpiresAt: past},
+			scopes:   []string{"openid"},
+			audience: nil,
+			want:     false,
+		},
+		{
+			name:     "covers requested scopes and audience",
+			grant:    &Grant{Scopes: []string{"openid", "profile"}, Audience: []string{"api"}, ExpiresAt: future},
+			scopes:   []string{"openid"},
+			audience: []string{"api"},
+			want:     true,
+		},
+		{
+			name:     "missing requested audience",
+			grant:    &Grant{Scopes: []string{"openid"}, Audience: []string{"api"}, ExpiresAt: future},
+			scopes:   []string{"openid"},
+			audience: []string{"other-api"},
+			want:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.grant.covers(tt.scopes, tt.audience); got != tt.want {
+				t.Errorf("Grant.covers(%v, %v) = %v, want %v", tt.scopes, tt.audience, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryConsentGrantStorer(t *testing.T) {
+	store := NewMemoryConsentGrantStorer()
+	ctx := context.Background()
+
+	if grant, err := store.FindGrant(ctx, "user1", "client1"); err != nil || grant != nil {
+		t.Fatalf("FindGrant on empty store = %v, %v; want nil, nil", grant, err)
+	}
+
+	expiresAt := time.Now().Add(time.Hour)
+	if err := store.SaveGrant(ctx, "user1", "client1", []string{"openid"}, []string{"api"}, expiresAt); err != nil {
+		t.Fatalf("SaveGrant() err = %v", err)
+	}
+
+	grant, err := store.FindGrant(ctx, "user1", "client1")
+	if err != nil {
+		t.Fatalf("FindGrant() err = %v", err)
+	}
+	if grant == nil || !grant.covers([]string{"openid"}, []string{"api"}) {
+		t.Fatalf("FindGrant() = %+v, want a grant covering openid/api", grant)
+	}
+
+	if err := store.RevokeGrants(ctx, "user1"); err != nil {
+		t.Fatalf("RevokeGrants() err = %v", err)
+	}
+	if grant, err := store.FindGrant(ctx, "user1", "client1"); err != nil || grant != nil {
+		t.Fatalf("FindGrant() after revoke = %v, %v; want nil, nil", grant, err)
+	}
+}
@@ -0,0 +1,238 @@
+// Package hconsenter is a thin client for the subset of the ORY Hydra
+// admin API the hydra module needs to drive the login/consent/logout
+// flows: https://www.ory.sh/hydra/docs/reference/api.
+package hconsenter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Client talks to a single Hydra admin API base URL.
+type Client struct {
+	AdminURL   string
+	HTTPClient *http.Client
+}
+
+// NewClient builds a Client against adminURL with an HTTP client that
+// times out requests after timeout.
+func NewClient(adminURL string, timeout time.Duration) *Client {
+	return &Client{
+		AdminURL:   adminURL,
+		HTTPClient: &http.Client{Timeout: timeout},
+	}
+}
+
+// APIError is returned when Hydra responds with a non-2xx status. It
+// implements the statusCoder interface the hydra package uses to detect
+// an already-consumed challenge.
+type APIError struct {
+	Status int
+	Body   string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("hconsenter: hydra admin API returned status %d: %s", e.Status, e.Body)
+}
+
+// StatusCode lets callers distinguish, for example, a double-submitted
+// logout challenge (404/410) from a genuine failure.
+func (e *APIError) StatusCode() int { return e.Status }
+
+// ClientInfo mirrors the subset of Hydra's OAuth2Client fields the hydra
+// module surfaces to its templates and uses for logout dispatch.
+type ClientInfo struct {
+	ClientID               string                 `json:"client_id"`
+	Contacts               []string               `json:"contacts"`
+	ClientURI              string                 `json:"client_uri"`
+	LogoURI                string                 `json:"logo_uri"`
+	Metadata               map[string]interface{} `json:"metadata"`
+	Name                   string                 `json:"client_name"`
+	Owner                  string                 `json:"owner"`
+	PolicyURI              string                 `json:"policy_uri"`
+	PostLogoutRedirectURIs []string               `json:"post_logout_redirect_uris"`
+	RedirectURIs           []string               `json:"redirect_uris"`
+	FrontChannelLogoutURI  string                 `json:"frontchannel_logout_uri"`
+	BackChannelLogoutURI   string                 `json:"backchannel_logout_uri"`
+}
+
+// GetLoginResponse is the body of a GET /admin/oauth2/auth/requests/login.
+type GetLoginResponse struct {
+	Skip              bool        `json:"skip"`
+	Subject           string      `json:"subject"`
+	RequestURL        string      `json:"request_url"`
+	RequestedAudience []string    `json:"requested_access_token_audience"`
+	RequestedScope    []string    `json:"requested_scope"`
+	SessionID         string      `json:"session_id"`
+	Client            *ClientInfo `json:"client"`
+}
+
+// GetConsentResponse is the body of a GET /admin/oauth2/auth/requests/consent.
+type GetConsentResponse struct {
+	Skip              bool        `json:"skip"`
+	Subject           string      `json:"subject"`
+	RequestURL        string      `json:"request_url"`
+	RequestedAudience []string    `json:"requested_access_token_audience"`
+	RequestedScope    []string    `json:"requested_scope"`
+	LoginSessionID    string      `json:"login_session_id"`
+	Context           interface{} `json:"context"`
+	Client            *ClientInfo `json:"client"`
+}
+
+// GetLogoutResponse is the body of a GET /admin/oauth2/auth/requests/logout.
+type GetLogoutResponse struct {
+	RequestURL  string      `json:"request_url"`
+	SessionID   string      `json:"sid"`
+	Subject     string      `json:"subject"`
+	RPInitiated bool        `json:"rp_initiated"`
+	Client      *ClientInfo `json:"client"`
+}
+
+// AcceptResponse is returned by the accept/reject login, consent and
+// logout endpoints; they all share this shape.
+type AcceptResponse struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body interface{}, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(raw)
+	}
+
+	u := c.AdminURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return &APIError{Status: resp.StatusCode, Body: string(respBody)}
+	}
+
+	if out == nil || len(respBody) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// GetLogin fetches a login request by challenge.
+func (c *Client) GetLogin(challenge string) (GetLoginResponse, error) {
+	var out GetLoginResponse
+	query := url.Values{"login_challenge": {challenge}}
+	err := c.do(context.Background(), http.MethodGet, "/admin/oauth2/auth/requests/login", query, nil, &out)
+	return out, err
+}
+
+// AcceptLogin accepts a login request, submitting body as the request payload.
+func (c *Client) AcceptLogin(challenge string, body map[string]interface{}) (*AcceptResponse, error) {
+	var out AcceptResponse
+	query := url.Values{"login_challenge": {challenge}}
+	err := c.do(context.Background(), http.MethodPut, "/admin/oauth2/auth/requests/login/accept", query, body, &out)
+	return &out, err
+}
+
+// GetConsent fetches a consent request by challenge.
+func (c *Client) GetConsent(challenge string) (GetConsentResponse, error) {
+	var out GetConsentResponse
+	query := url.Values{"consent_challenge": {challenge}}
+	err := c.do(context.Background(), http.MethodGet, "/admin/oauth2/auth/requests/consent", query, nil, &out)
+	return out, err
+}
+
+// AcceptConsent accepts a consent request, submitting body as the request payload.
+func (c *Client) AcceptConsent(challenge string, body map[string]interface{}) (*AcceptResponse, error) {
+	var out AcceptResponse
+	query := url.Values{"consent_challenge": {challenge}}
+	err := c.do(context.Background(), http.MethodPut, "/admin/oauth2/auth/requests/consent/accept", query, body, &out)
+	return &out, err
+}
+
+// RejectConsent rejects a consent request, submitting body as the error payload.
+func (c *Client) RejectConsent(challenge string, body map[string]interface{}) (*AcceptResponse, error) {
+	var out AcceptResponse
+	query := url.Values{"consent_challenge": {challenge}}
+	err := c.do(context.Background(), http.MethodPut, "/admin/oauth2/auth/requests/consent/reject", query, body, &out)
+	return &out, err
+}
+
+// GetLogout fetches a logout request by challenge.
+func (c *Client) GetLogout(challenge string) (GetLogoutResponse, error) {
+	var out GetLogoutResponse
+	query := url.Values{"logout_challenge": {challenge}}
+	err := c.do(context.Background(), http.MethodGet, "/admin/oauth2/auth/requests/logout", query, nil, &out)
+	return out, err
+}
+
+// AcceptLogout accepts a logout request.
+func (c *Client) AcceptLogout(challenge string) (*AcceptResponse, error) {
+	var out AcceptResponse
+	query := url.Values{"logout_challenge": {challenge}}
+	err := c.do(context.Background(), http.MethodPut, "/admin/oauth2/auth/requests/logout/accept", query, nil, &out)
+	return &out, err
+}
+
+// RejectLogout rejects a logout request.
+func (c *Client) RejectLogout(challenge string) (*AcceptResponse, error) {
+	var out AcceptResponse
+	query := url.Values{"logout_challenge": {challenge}}
+	err := c.do(context.Background(), http.MethodPut, "/admin/oauth2/auth/requests/logout/reject", query, nil, &out)
+	return &out, err
+}
+
+// ListSessionClients returns every client holding a consent session tied to
+// the specific login session sid, via GET
+// /admin/oauth2/auth/sessions/consent, so a logout can fan
+// front-channel/back-channel logout out to each of them. Hydra's endpoint
+// only filters by subject, so sessions belonging to the subject's other
+// (still-active) login sessions are filtered out here by login_session_id.
+func (c *Client) ListSessionClients(subject, sid string) ([]*ClientInfo, error) {
+	var sessions []struct {
+		ConsentRequest struct {
+			Client *ClientInfo `json:"client"`
+		} `json:"consent_request"`
+		LoginSessionID string `json:"login_session_id"`
+	}
+	query := url.Values{"subject": {subject}}
+	err := c.do(context.Background(), http.MethodGet, "/admin/oauth2/auth/sessions/consent", query, nil, &sessions)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := make([]*ClientInfo, 0, len(sessions))
+	for _, s := range sessions {
+		if s.LoginSessionID != sid {
+			continue
+		}
+		if s.ConsentRequest.Client != nil {
+			clients = append(clients, s.ConsentRequest.Client)
+		}
+	}
+	return clients, nil
+}
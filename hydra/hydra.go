@@ -5,12 +5,10 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"os"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/ashtonian/authboss/hydra/hconsenter"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/volatiletech/authboss"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -78,19 +76,89 @@ func init() {
 	authboss.RegisterModule("hydraconsent", &HydraConsent{})
 }
 
+// Config configures a HydraConsent module instance. Construct one with
+// NewHydraConsent to get a module that can be wired up to its own Hydra
+// backend independent of any other instance in the process. The zero-value
+// instance this package registers with authboss.RegisterModule under the
+// "hydraconsent" name gets the same defaults Init always applied, filled in
+// by Init via setDefaults.
+type Config struct {
+	HydraAdminURL string
+	HTTPClient    *http.Client
+
+	RememberFor               int
+	OverrideRequestedAudience bool
+
+	// ConsentSkipPredicate, LoginSkipPredicate and LogoutSkipPredicate let
+	// callers auto-approve a challenge beyond what Hydra's own Skip flag
+	// already covers, e.g. trusted request URLs or known client IDs.
+	ConsentSkipPredicate func(hconsenter.GetConsentResponse) bool
+	LoginSkipPredicate   func(hconsenter.GetLoginResponse) bool
+	LogoutSkipPredicate  func(hconsenter.GetLogoutResponse) bool
+
+	WebAuthnRPID             string
+	WebAuthnRPOrigin         string
+	WebAuthnDisplayName      string
+	WebAuthnCredentialStorer WebAuthnCredentialStorer
+
+	Issuer             string
+	LogoutFallbackPath string
+	LogoutTokenSigner  LogoutTokenSigner
+
+	ConsentGrantStorer ConsentGrantStorer
+
+	MagicLinkStorer  MagicLinkStorer
+	MagicLinkTTL     time.Duration
+	MagicLinkBaseURL string
+}
+
+func (c *Config) setDefaults() {
+	if c.HydraAdminURL == "" {
+		c.HydraAdminURL = "http://localhost:4445"
+	}
+	if c.RememberFor == 0 {
+		c.RememberFor = 3600
+	}
+	if c.WebAuthnDisplayName == "" {
+		c.WebAuthnDisplayName = "Authboss"
+	}
+	if c.LogoutFallbackPath == "" {
+		c.LogoutFallbackPath = "/"
+	}
+	if c.MagicLinkTTL == 0 {
+		c.MagicLinkTTL = magicLinkDefaultTTL
+	}
+}
+
 // HydraConsent module
 type HydraConsent struct {
 	*authboss.Authboss
-	hClient                   *hconsenter.Client
-	rememberMe                int
-	ignoreConsent             map[string]bool
-	overrideRequestedAudience bool
+	cfg     Config
+	hClient *hconsenter.Client
+
+	webauthn         *webauthn.WebAuthn
+	magicLinkLimiter *magicLinkRateLimiter
+
+	// hydraHandlers backs the module's own small event bus (see
+	// events.go); it's per-instance so two HydraConsent instances running
+	// against different Hydra backends in the same process don't share
+	// handlers.
+	hydraHandlers map[hydraEvent][]HydraEventHandler
+}
+
+// NewHydraConsent builds a HydraConsent module from cfg. Use this over the
+// zero-value construction authboss.RegisterModule performs when more than
+// one instance needs to talk to a different Hydra backend in the same
+// process, or when tests need to supply fakes for ConsentGrantStorer,
+// LogoutTokenSigner, etc.
+func NewHydraConsent(cfg Config) *HydraConsent {
+	return &HydraConsent{cfg: cfg}
 }
 
 // Init module
 func (a *HydraConsent) Init(ab *authboss.Authboss) (err error) {
 	a.Authboss = ab
-	a.rememberMe = 3600
+	a.cfg.setDefaults()
 
 	if err = a.Authboss.Config.Core.ViewRenderer.Load(PageLogin); err != nil {
 		return err
@@ -101,28 +169,35 @@ func (a *HydraConsent) Init(ab *authboss.Authboss) (err error) {
 	if err = a.Authboss.Config.Core.ViewRenderer.Load(PageConsent); err != nil {
 		return err
 	}
+	if err = a.Authboss.Config.Core.ViewRenderer.Load(PageLogoutFrontChannel); err != nil {
+		return err
+	}
+	if err = a.Authboss.Config.Core.ViewRenderer.Load(PageMagicLogin); err != nil {
+		return err
+	}
+	if err = a.Authboss.Config.Core.MailRenderer.Load(PageMagicEmail); err != nil {
+		return err
+	}
 
 	a.Authboss.Config.Core.Router.Get("/login", a.Authboss.Core.ErrorHandler.Wrap(a.LoginGet))
 	a.Authboss.Config.Core.Router.Post("/login", a.Authboss.Core.ErrorHandler.Wrap(a.LoginPost))
 	a.Authboss.Config.Core.Router.Get("/consent", a.Authboss.Core.ErrorHandler.Wrap(a.ConsentGet))
 	a.Authboss.Config.Core.Router.Post("/consent", a.Authboss.Core.ErrorHandler.Wrap(a.ConsentPost))
+	a.Authboss.Config.Core.Router.Post("/consent/revoke", a.Authboss.Core.ErrorHandler.Wrap(a.ConsentRevokePost))
+	a.Authboss.Config.Core.Router.Post("/login/magic/request", a.Authboss.Core.ErrorHandler.Wrap(a.MagicLinkRequestPost))
+	a.Authboss.Config.Core.Router.Get("/login/magic/verify", a.Authboss.Core.ErrorHandler.Wrap(a.MagicLinkVerifyGet))
 	a.Authboss.Config.Core.Router.Get("/logout", a.Authboss.Core.ErrorHandler.Wrap(a.LogoutGet))
-	a.Authboss.Config.Core.Router.Post("/logout", a.Authboss.Core.ErrorHandler.Wrap(a.LoginPost))
+	a.Authboss.Config.Core.Router.Post("/logout", a.Authboss.Core.ErrorHandler.Wrap(a.LogoutPost))
 
-	overrideRaw := os.Getenv("OVERRIDE_REQUESTED_AUDIENCE")
-	override, _ := strconv.ParseBool(overrideRaw)
-	a.overrideRequestedAudience = override
-
-	whiteList := os.Getenv("CONSENT_WHITELIST")
-	a.ignoreConsent = map[string]bool{}
-	for _, k := range strings.Split(whiteList, ",") {
-		a.ignoreConsent[k] = true
+	a.hClient = hconsenter.NewClient(a.cfg.HydraAdminURL, 30*time.Second)
+	if a.cfg.HTTPClient != nil {
+		a.hClient.HTTPClient = a.cfg.HTTPClient
 	}
-	hydraURL := os.Getenv("HYDRA_ADMIN_URL")
-	if hydraURL == "" {
-		hydraURL = "http://localhost:4445"
+
+	if err = a.initWebAuthn(); err != nil {
+		return err
 	}
-	a.hClient = hconsenter.NewClient(hydraURL, 30*time.Second)
+	a.magicLinkLimiter = newMagicLinkRateLimiter()
 
 	ab.Events.After(authboss.EventAuthFail, func(w http.ResponseWriter, r *http.Request, handled bool) (bool, error) {
 		// TODO: reject post loginRequestOnFailEvent for hydra after user fails x # of times ?
@@ -135,16 +210,28 @@ func (a *HydraConsent) Init(ab *authboss.Authboss) (err error) {
 			return false, err
 		}
 
-		validatable, err := a.Authboss.Core.BodyReader.Read(PageLogin, r)
-		if err != nil {
-			return false, err
+		// WebAuthn and magic-link logins (LoginWebAuthnFinishPost,
+		// MagicLinkVerifyGet) already resolved the login_challenge and
+		// stashed it in context; this hook shouldn't need to know which
+		// authenticator succeeded, so only fall back to re-reading the
+		// password PageLogin body when that context value is absent.
+		var rememberMe bool
+		ch, ok := r.Context().Value(ChallengeKey).(string)
+		if !ok {
+			validatable, err := a.Authboss.Core.BodyReader.Read(PageLogin, r)
+			if err != nil {
+				return false, err
+			}
+
+			challengeForm := MustHaveChallenge(validatable)
+			ch = challengeForm.GetChallenge()
+			r = r.WithContext(context.WithValue(r.Context(), ChallengeKey, ch))
+
+			if u, ok := validatable.(authboss.RememberValuer); ok {
+				rememberMe = u.GetShouldRemember()
+			}
 		}
 
-		// Add challenge to context
-		challengeForm := MustHaveChallenge(validatable)
-		ch := challengeForm.GetChallenge()
-		r = r.WithContext(context.WithValue(r.Context(), ChallengeKey, ch))
-
 		// add challenge key to view data
 		data, ok := r.Context().Value(authboss.CTXKeyData).(authboss.HTMLData)
 		data = data.MergeKV(ChallengeKey, ch)
@@ -152,17 +239,28 @@ func (a *HydraConsent) Init(ab *authboss.Authboss) (err error) {
 			r = r.WithContext(context.WithValue(r.Context(), authboss.CTXKeyData, data))
 		}
 
-		rememberMe := false
-		u, ok := validatable.(authboss.RememberValuer)
-		if !ok {
-			rememberMe = u.GetShouldRemember()
+		loginInfo, err := a.hClient.GetLogin(ch)
+		if err != nil {
+			return false, err
+		}
+		fullUser, err := a.Authboss.Storage.Server.Load(r.Context(), usr)
+		if err != nil {
+			return false, err
 		}
 
 		body := map[string]interface{}{
 			"subject":      usr,
 			"remember":     rememberMe,
-			"remember_for": a.rememberMe,
+			"remember_for": a.cfg.RememberFor,
+			"session":      sessionPayload(r.Context(), fullUser, loginInfo.RequestedScope, loginInfo.RequestedAudience),
 		}
+		r = r.WithContext(context.WithValue(r.Context(), hydraBodyKey, body))
+		if handled, err := a.fireHydraEvent(EventHydraBeforeAcceptLogin, w, r); err != nil {
+			return false, err
+		} else if handled {
+			return true, nil
+		}
+
 		res, err := a.hClient.AcceptLogin(ch, body)
 		if err != nil {
 			return false, err
@@ -206,10 +304,16 @@ func (a *HydraConsent) ConsentGet(w http.ResponseWriter, r *http.Request) error
 		return err
 	}
 
-	v, found := a.ignoreConsent[getRes.RequestURL]
-	noConsent := false || a.ignoreConsent["*"]
-	if found && v {
-		noConsent = true
+	noConsent := getRes.Skip
+	if !noConsent && a.cfg.ConsentSkipPredicate != nil {
+		noConsent = a.cfg.ConsentSkipPredicate(getRes)
+	}
+	if !noConsent && a.cfg.ConsentGrantStorer != nil {
+		grant, err := a.cfg.ConsentGrantStorer.FindGrant(r.Context(), getRes.Subject, getRes.Client.ClientID)
+		if err != nil {
+			return err
+		}
+		noConsent = grant.covers(getRes.RequestedScope, getRes.RequestedAudience)
 	}
 
 	usr, err := a.LoadCurrentUser(&r)
@@ -217,18 +321,18 @@ func (a *HydraConsent) ConsentGet(w http.ResponseWriter, r *http.Request) error
 		return err
 	}
 
-	session := map[string]interface{}{}
-	sessionable, ok := usr.(SessionableUser)
-	if ok {
-		session = sessionable.GetSession()
-	}
-	if getRes.Skip || noConsent {
-
-		//  TODO: it would be nice if we could add an event here for people to attach to
+	if noConsent {
 		body := map[string]interface{}{
 			"grant_scope":                 getRes.RequestedScope,
 			"grant_access_token_audience": getRes.RequestedAudience,
-			"session":                     session,
+			"session":                     sessionPayload(r.Context(), usr, getRes.RequestedScope, getRes.RequestedAudience),
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), hydraBodyKey, body))
+		if handled, err := a.fireHydraEvent(EventHydraConsentSkip, w, r); err != nil {
+			return err
+		} else if handled {
+			return nil
 		}
 
 		accRes, err := a.hClient.AcceptConsent(ch, body)
@@ -292,7 +396,7 @@ func (a *HydraConsent) ConsentPost(w http.ResponseWriter, r *http.Request) error
 	}
 	requestedAudience := res.RequestedAudience
 
-	if a.overrideRequestedAudience {
+	if a.cfg.OverrideRequestedAudience {
 		requestedAudience = consentForm.GetRequestedAudience()
 
 	}
@@ -307,18 +411,22 @@ func (a *HydraConsent) ConsentPost(w http.ResponseWriter, r *http.Request) error
 		return err
 	}
 
-	session := map[string]interface{}{}
-	sessionable, ok := usr.(SessionableUser)
-	if ok {
-		session = sessionable.GetSession()
-	}
+	session := sessionPayload(r.Context(), usr, grantedScopes, requestedAudience)
 
 	body := map[string]interface{}{
 		"grant_scope":                 grantedScopes,
 		"grant_access_token_audience": requestedAudience,
 		"session":                     session,
 		"remember":                    rememberMe,
-		"remember_for":                a.rememberMe,
+		"remember_for":                a.cfg.RememberFor,
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), UserInfoClaimsKey, userInfoClaims(r.Context(), usr, grantedScopes)))
+	r = r.WithContext(context.WithValue(r.Context(), hydraBodyKey, body))
+	if handled, err := a.fireHydraEvent(EventHydraBeforeAcceptConsent, w, r); err != nil {
+		return err
+	} else if handled {
+		return nil
 	}
 
 	accRes, err := a.hClient.AcceptConsent(ch, body)
@@ -326,6 +434,14 @@ func (a *HydraConsent) ConsentPost(w http.ResponseWriter, r *http.Request) error
 		return err
 	}
 
+	if a.cfg.ConsentGrantStorer != nil {
+		expiresAt := time.Now().Add(time.Duration(a.cfg.RememberFor) * time.Second)
+		err = a.cfg.ConsentGrantStorer.SaveGrant(r.Context(), res.Subject, res.Client.ClientID, grantedScopes, requestedAudience, expiresAt)
+		if err != nil {
+			return err
+		}
+	}
+
 	http.Redirect(w, r, accRes.RedirectTo, http.StatusFound)
 
 	return nil
@@ -343,13 +459,22 @@ func (a *HydraConsent) LoginGet(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	if res.Skip {
-		/* TODO:
-		- would be nice to add an event 'LoginSkip' here for users to create a callback for
-		*/
+	skip := res.Skip
+	if !skip && a.cfg.LoginSkipPredicate != nil {
+		skip = a.cfg.LoginSkipPredicate(res)
+	}
+	if skip {
 		body := map[string]interface{}{
 			"subject": res.Subject,
 		}
+
+		r = r.WithContext(context.WithValue(r.Context(), hydraBodyKey, body))
+		if handled, err := a.fireHydraEvent(EventHydraLoginSkip, w, r); err != nil {
+			return err
+		} else if handled {
+			return nil
+		}
+
 		res, err := a.hClient.AcceptLogin(ch, body)
 		if err != nil {
 			return err
@@ -457,7 +582,8 @@ func (a *HydraConsent) LoginPost(w http.ResponseWriter, r *http.Request) error {
 	return a.Authboss.Core.Redirector.Redirect(w, r, ro)
 }
 
-// TODO: add get logout flow and prompt user for logout option
+// LogoutGet renders the logout confirmation page when Hydra requires the
+// user to be prompted before an RP-Initiated Logout is accepted.
 func (a *HydraConsent) LogoutGet(w http.ResponseWriter, r *http.Request) error {
 	ch := r.URL.Query().Get("logout_challenge")
 	if ch == "" {
@@ -468,12 +594,22 @@ func (a *HydraConsent) LogoutGet(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	if a.cfg.LogoutSkipPredicate != nil && a.cfg.LogoutSkipPredicate(res) {
+		acceptRes, err := a.hClient.AcceptLogout(ch)
+		if err != nil {
+			return err
+		}
+		return a.dispatchSessionLogout(w, r, res.Subject, res.SessionID, acceptRes.RedirectTo)
+	}
+
 	// add challenge key to context
 	r = r.WithContext(context.WithValue(r.Context(), ChallengeKey, ch))
 
 	// add challenge key and related to view data
 	data, ok := r.Context().Value(authboss.CTXKeyData).(authboss.HTMLData)
 	data = data.MergeKV(ChallengeKey, ch)
+	data = data.MergeKV("rp_initiated", res.RPInitiated)
+	data = data.MergeKV("client", toMap(res.Client))
 	data = data.MergeKV("request_url", res.RequestURL)
 	data = data.MergeKV("session_id", res.SessionID)
 	data = data.MergeKV("subject", res.Subject)
@@ -481,7 +617,7 @@ func (a *HydraConsent) LogoutGet(w http.ResponseWriter, r *http.Request) error {
 		r = r.WithContext(context.WithValue(r.Context(), authboss.CTXKeyData, data))
 	}
 
-	return nil
+	return a.Core.Responder.Respond(w, r, http.StatusOK, PageLogout, data)
 }
 
 // TODO: original source code sourced from logout module
@@ -517,25 +653,38 @@ func (a *HydraConsent) LogoutPost(w http.ResponseWriter, r *http.Request) error
 		logger.Info("user (unknown) logged out")
 	}
 
+	// verify challenge, and keep the subject/session around for the
+	// front/back-channel dispatch below
+	logoutInfo, err := a.hClient.GetLogout(ch)
+	if err != nil {
+		return err
+	}
+
 	authboss.DelAllSession(w, a.Config.Storage.SessionStateWhitelistKeys)
 	authboss.DelKnownSession(w)
 	authboss.DelKnownCookie(w)
 
-	// verify challenge
-	_, err = a.hClient.GetLogout(ch)
-	if err != nil {
+	r = r.WithContext(context.WithValue(r.Context(), hydraBodyKey, map[string]interface{}{"challenge": ch}))
+	if handled, err := a.fireHydraEvent(EventHydraBeforeAcceptLogout, w, r); err != nil {
 		return err
+	} else if handled {
+		return nil
 	}
 
 	res2, err := a.hClient.AcceptLogout(ch)
 	if err != nil {
+		if isChallengeAlreadyConsumed(err) {
+			// Double submit: the challenge was already accepted by an
+			// earlier request for this same logout. Treat it as success.
+			ro := authboss.RedirectOptions{
+				Code:         http.StatusTemporaryRedirect,
+				RedirectPath: a.cfg.LogoutFallbackPath,
+				Success:      "You have been logged out",
+			}
+			return a.Authboss.Core.Redirector.Redirect(w, r, ro)
+		}
 		return err
 	}
 
-	ro := authboss.RedirectOptions{
-		Code:         http.StatusTemporaryRedirect,
-		RedirectPath: res2.RedirectTo, // a.Authboss.Paths.LogoutOK,
-		Success:      "You have been logged out",
-	}
-	return a.Authboss.Core.Redirector.Redirect(w, r, ro)
+	return a.dispatchSessionLogout(w, r, logoutInfo.Subject, logoutInfo.SessionID, res2.RedirectTo)
 }
@@ -0,0 +1,118 @@
+package hydra
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/volatiletech/authboss"
+)
+
+// PageLogoutFrontChannel renders the hidden iframes used to fan out OIDC
+// front-channel logout to every relying party that held a session, before
+// the browser is finally sent to Hydra's RedirectTo.
+const PageLogoutFrontChannel = "logout_frontchannel"
+
+// LogoutTokenSigner produces a signed OIDC back-channel logout_token JWT
+// (aud=client_id, sub, sid, events claim
+// http://schemas.openid.net/event/backchannel-logout) for a relying party
+// registered with a backchannel_logout_uri.
+type LogoutTokenSigner interface {
+	SignLogoutToken(clientID, subject, sid string) (string, error)
+}
+
+// statusCoder is satisfied by hconsenter errors that carry the HTTP status
+// returned by Hydra, letting us distinguish an already-consumed challenge
+// (404/410) from a real failure without hconsenter needing to export a
+// sentinel error type.
+type statusCoder interface {
+	StatusCode() int
+}
+
+func isChallengeAlreadyConsumed(err error) bool {
+	sc, ok := err.(statusCoder)
+	if !ok {
+		return false
+	}
+	code := sc.StatusCode()
+	return code == http.StatusNotFound || code == http.StatusGone
+}
+
+// dispatchSessionLogout notifies every client that held a session for
+// subject/sid via OIDC front-channel and back-channel logout before sending
+// the browser to redirectTo. Front-channel clients are rendered as hidden
+// iframes on an interstitial page; back-channel clients are POSTed a signed
+// logout_token directly when a LogoutTokenSigner is configured, and skipped
+// otherwise. A failed back-channel POST is logged and does not stop the
+// logout.
+func (a *HydraConsent) dispatchSessionLogout(w http.ResponseWriter, r *http.Request, subject, sid, redirectTo string) error {
+	logger := a.RequestLogger(r)
+
+	clients, err := a.hClient.ListSessionClients(subject, sid)
+	if err != nil {
+		return err
+	}
+
+	var frontChannelURIs []string
+	for _, c := range clients {
+		if c.BackChannelLogoutURI != "" && a.cfg.LogoutTokenSigner != nil {
+			if err := a.sendBackChannelLogout(c.ClientID, c.BackChannelLogoutURI, subject, sid); err != nil {
+				logger.Errorf("back-channel logout to client %s failed: %v", c.ClientID, err)
+			}
+		}
+		if c.FrontChannelLogoutURI != "" {
+			frontChannelURIs = append(frontChannelURIs, addQueryParams(c.FrontChannelLogoutURI, a.cfg.Issuer, sid))
+		}
+	}
+
+	if len(frontChannelURIs) == 0 {
+		ro := authboss.RedirectOptions{
+			Code:         http.StatusTemporaryRedirect,
+			RedirectPath: redirectTo,
+			Success:      "You have been logged out",
+		}
+		return a.Authboss.Core.Redirector.Redirect(w, r, ro)
+	}
+
+	data := authboss.HTMLData{
+		"iframes":     frontChannelURIs,
+		"redirect_to": redirectTo,
+	}
+	return a.Core.Responder.Respond(w, r, http.StatusOK, PageLogoutFrontChannel, data)
+}
+
+// addQueryParams appends the OIDC front-channel logout iss/sid params to
+// rawURL, merging with any query string rawURL already has (a
+// frontchannel_logout_uri is free to include one) instead of always
+// prepending "?".
+func addQueryParams(rawURL, iss, sid string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// Fall back to the naive form rather than dropping the client.
+		return fmt.Sprintf("%s?iss=%s&sid=%s", rawURL, url.QueryEscape(iss), url.QueryEscape(sid))
+	}
+
+	q := u.Query()
+	q.Set("iss", iss)
+	q.Set("sid", sid)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (a *HydraConsent) sendBackChannelLogout(clientID, backChannelURI, subject, sid string) error {
+	token, err := a.cfg.LogoutTokenSigner.SignLogoutToken(clientID, subject, sid)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.PostForm(backChannelURI, url.Values{"logout_token": {token}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("back-channel logout to %s returned status %d", backChannelURI, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package hydra
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/volatiletech/authboss"
+)
+
+const (
+	// PageMagicLogin identifies the magic-link request page for the view
+	// renderer.
+	PageMagicLogin = "magic_login"
+	// PageMagicEmail identifies the magic-link email body for the mail
+	// renderer.
+	PageMagicEmail = "magic_email"
+
+	magicLinkTokenBytes = 32
+	magicLinkDefaultTTL = 15 * time.Minute
+
+	magicLinkRateLimit  = 5
+	magicLinkRateWindow = 15 * time.Minute
+)
+
+var (
+	// ErrMagicLinkInvalid is returned when a magic-link token doesn't
+	// exist, has already been used, or has expired.
+	ErrMagicLinkInvalid = errors.New("hydra: magic link token is invalid or expired")
+	// ErrMagicLinkRateLimited is returned when too many magic-link
+	// requests have been made for an email address, or from an IP address,
+	// within the last magicLinkRateWindow.
+	ErrMagicLinkRateLimited = errors.New("hydra: too many magic link requests")
+)
+
+// MagicLinkToken is what a MagicLinkStorer persists for a single
+// outstanding (or spent) magic-link login attempt.
+type MagicLinkToken struct {
+	Subject        string
+	LoginChallenge string
+	ExpiresAt      time.Time
+	Used           bool
+}
+
+// MagicLinkStorer persists magic-link login tokens, keyed by the SHA-256
+// hash of the token value mailed to the user (never the raw token).
+type MagicLinkStorer interface {
+	SaveToken(ctx context.Context, hashedToken, subject, loginChallenge string, expiresAt time.Time) error
+	// ConsumeToken looks up hashedToken and atomically marks it used. It
+	// returns ErrMagicLinkInvalid if the token is unknown, already used,
+	// or expired.
+	ConsumeToken(ctx context.Context, hashedToken string) (*MagicLinkToken, error)
+}
+
+// MemoryMagicLinkStorer is an in-memory MagicLinkStorer suitable for
+// development and tests; production deployments should back
+// MagicLinkStorer with SQL the same way authboss's other storers are
+// typically backed.
+type MemoryMagicLinkStorer struct {
+	mu     sync.Mutex
+	tokens map[string]*MagicLinkToken
+}
+
+// NewMemoryMagicLinkStorer returns an empty MemoryMagicLinkStorer.
+func NewMemoryMagicLinkStorer() *MemoryMagicLinkStorer {
+	return &MemoryMagicLinkStorer{tokens: make(map[string]*MagicLinkToken)}
+}
+
+// SaveToken implements MagicLinkStorer.
+func (m *MemoryMagicLinkStorer) SaveToken(ctx context.Context, hashedToken, subject, loginChallenge string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tokens[hashedToken] = &MagicLinkToken{
+		Subject:        subject,
+		LoginChallenge: loginChallenge,
+		ExpiresAt:      expiresAt,
+	}
+	return nil
+}
+
+// ConsumeToken implements MagicLinkStorer.
+func (m *MemoryMagicLinkStorer) ConsumeToken(ctx context.Context, hashedToken string) (*MagicLinkToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tok, ok := m.tokens[hashedToken]
+	if !ok || tok.Used || tok.ExpiresAt.Before(time.Now()) {
+		return nil, ErrMagicLinkInvalid
+	}
+	tok.Used = true
+	return tok, nil
+}
+
+// magicLinkRateLimiter is a small sliding-window request counter, keyed by
+// caller-supplied strings (email, IP), guarding MagicLinkRequestPost
+// against abuse.
+type magicLinkRateLimiter struct {
+	mu     sync.Mutex
+	counts map[string][]time.Time
+}
+
+func newMagicLinkRateLimiter() *magicLinkRateLimiter {
+	return &magicLinkRateLimiter{counts: make(map[string][]time.Time)}
+}
+
+func (rl *magicLinkRateLimiter) allow(key string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-magicLinkRateWindow)
+
+	hits := rl.counts[key][:0]
+	for _, t := range rl.counts[key] {
+		if t.After(cutoff) {
+			hits = append(hits, t)
+		}
+	}
+	if len(hits) >= magicLinkRateLimit {
+		rl.counts[key] = hits
+		return false
+	}
+	rl.counts[key] = append(hits, now)
+	return true
+}
+
+// remoteIP returns the bare IP a request came from, stripping the ephemeral
+// source port net/http leaves in r.RemoteAddr (which differs per TCP
+// connection and would otherwise defeat IP-keyed rate limiting).
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func generateMagicLinkToken() (raw, hashed string, err error) {
+	buf := make([]byte, magicLinkTokenBytes)
+	if _, err = rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	raw = base64.RawURLEncoding.EncodeToString(buf)
+	sum := sha256.Sum256([]byte(raw))
+	hashed = hex.EncodeToString(sum[:])
+	return raw, hashed, nil
+}
+
+// MagicLinkRequestPost generates a single-use magic link for the email
+// address in the request, rate-limited per email/IP, and mails it via
+// a.Authboss.Config.Core.Mailer. It always responds the same way whether
+// or not the email matches a user, so it can't be used to enumerate
+// accounts.
+func (a *HydraConsent) MagicLinkRequestPost(w http.ResponseWriter, r *http.Request) error {
+	if a.cfg.MagicLinkStorer == nil {
+		return errors.New("hydra: MagicLinkStorer not configured")
+	}
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	email := r.FormValue("email")
+	ch := r.FormValue("login_challenge")
+
+	if !a.magicLinkLimiter.allow(email) || !a.magicLinkLimiter.allow(remoteIP(r)) {
+		return ErrMagicLinkRateLimited
+	}
+
+	// The login_challenge is attacker-controlled (this endpoint is
+	// unauthenticated); confirm it's a real, outstanding Hydra login
+	// request before persisting or mailing anything built from it.
+	if _, err := a.hClient.GetLogin(ch); err != nil {
+		return err
+	}
+
+	pidUser, err := a.Authboss.Storage.Server.Load(r.Context(), email)
+	if err != nil && err != authboss.ErrUserNotFound {
+		return err
+	}
+
+	if err == nil {
+		raw, hashed, err := generateMagicLinkToken()
+		if err != nil {
+			return err
+		}
+
+		if err = a.cfg.MagicLinkStorer.SaveToken(r.Context(), hashed, pidUser.GetPID(), ch, time.Now().Add(a.cfg.MagicLinkTTL)); err != nil {
+			return err
+		}
+
+		verifyURL := a.cfg.MagicLinkBaseURL + "/login/magic/verify?" + url.Values{
+			"token":           {raw},
+			"login_challenge": {ch},
+		}.Encode()
+		body, _, err := a.Authboss.Core.MailRenderer.Render(r.Context(), PageMagicEmail, authboss.HTMLData{"url": verifyURL})
+		if err != nil {
+			return err
+		}
+		if err = a.Authboss.Core.Mailer.Send(r.Context(), authboss.Email{
+			To:       []string{email},
+			Subject:  "Your login link",
+			HTMLBody: string(body),
+		}); err != nil {
+			return err
+		}
+	}
+
+	data := authboss.HTMLData{"sent": true}
+	return a.Core.Responder.Respond(w, r, http.StatusOK, PageMagicLogin, data)
+}
+
+// MagicLinkVerifyGet consumes a magic-link token, loads the associated
+// user, and fires authboss.EventAuth so the existing EventAuth after-hook
+// (which calls hClient.AcceptLogin) runs exactly as it does for password
+// and WebAuthn logins.
+func (a *HydraConsent) MagicLinkVerifyGet(w http.ResponseWriter, r *http.Request) error {
+	raw := r.URL.Query().Get("token")
+	sum := sha256.Sum256([]byte(raw))
+	hashed := hex.EncodeToString(sum[:])
+
+	tok, err := a.cfg.MagicLinkStorer.ConsumeToken(r.Context(), hashed)
+	if err != nil {
+		return err
+	}
+
+	usr, err := a.Authboss.Storage.Server.Load(r.Context(), tok.Subject)
+	if err != nil {
+		return err
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), authboss.CTXKeyUser, usr))
+	r = r.WithContext(context.WithValue(r.Context(), ChallengeKey, tok.LoginChallenge))
+
+	authboss.PutSession(w, authboss.SessionKey, usr.GetPID())
+
+	handled, err := a.Authboss.Events.FireAfter(authboss.EventAuth, w, r)
+	if err != nil {
+		return err
+	} else if handled {
+		return nil
+	}
+
+	ro := authboss.RedirectOptions{
+		Code:             http.StatusTemporaryRedirect,
+		RedirectPath:     a.Authboss.Paths.AuthLoginOK,
+		FollowRedirParam: true,
+	}
+	return a.Authboss.Core.Redirector.Redirect(w, r, ro)
+}
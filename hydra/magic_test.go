@@ -0,0 +1,67 @@
+package hydra
+
+import (
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+func TestGenerateMagicLinkToken(t *testing.T) {
+	raw, hashed, err := generateMagicLinkToken()
+	if err != nil {
+		t.Fatalf("generateMagicLinkToken() err = %v", err)
+	}
+	if raw == "" || hashed == "" {
+		t.Fatalf("generateMagicLinkToken() = %q, %q; want non-empty values", raw, hashed)
+	}
+	if _, err := hex.DecodeString(hashed); err != nil {
+		t.Errorf("hashed token %q is not valid hex: %v", hashed, err)
+	}
+
+	raw2, hashed2, err := generateMagicLinkToken()
+	if err != nil {
+		t.Fatalf("generateMagicLinkToken() second call err = %v", err)
+	}
+	if raw == raw2 || hashed == hashed2 {
+		t.Errorf("generateMagicLinkToken() produced the same token twice: %q, %q", raw, hashed)
+	}
+}
+
+func TestMagicLinkRateLimiterAllow(t *testing.T) {
+	rl := newMagicLinkRateLimiter()
+
+	for i := 0; i < magicLinkRateLimit; i++ {
+		if !rl.allow("key1") {
+			t.Fatalf("allow(%q) on attempt %d = false, want true", "key1", i+1)
+		}
+	}
+	if rl.allow("key1") {
+		t.Errorf("allow(%q) after %d attempts = true, want false (rate limit exceeded)", "key1", magicLinkRateLimit)
+	}
+
+	// A different key has its own independent bucket.
+	if !rl.allow("key2") {
+		t.Errorf("allow(%q) = false, want true (independent key)", "key2")
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       string
+	}{
+		{"host and port", "1.2.3.4:54321", "1.2.3.4"},
+		{"ipv6 with port", "[::1]:54321", "::1"},
+		{"no port", "1.2.3.4", "1.2.3.4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{RemoteAddr: tt.remoteAddr}
+			if got := remoteIP(r); got != tt.want {
+				t.Errorf("remoteIP(%q) = %q, want %q", tt.remoteAddr, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package hydra
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/volatiletech/authboss"
+)
+
+const (
+	// webauthnLoginSessionKeyPrefix namespaces the serialized SessionData
+	// stashed in the authboss session store while a WebAuthn ceremony is
+	// in flight, keyed by the Hydra login_challenge.
+	webauthnLoginSessionKeyPrefix = "webauthn_login_session_"
+	// webauthnRegisterSessionKeyPrefix is the same idea for registration
+	// ceremonies, keyed by the current user's PID instead of a challenge.
+	webauthnRegisterSessionKeyPrefix = "webauthn_register_session_"
+)
+
+// WebAuthnUser is implemented by a storage layer's user type to opt in to
+// WebAuthn/FIDO2 login and registration alongside the existing password
+// flow. The Hydra login/consent logic does not care which authenticator
+// satisfied the login_challenge, so this is kept independent of
+// SessionableUser and ConsentValuer.
+type WebAuthnUser interface {
+	authboss.User
+
+	WebAuthnID() []byte
+	WebAuthnName() string
+	WebAuthnCredentials() []webauthn.Credential
+}
+
+// WebAuthnCredentialStorer persists WebAuthn credentials for a user. It is
+// intentionally small so any backing store (SQL, in-memory, etc.) can
+// implement it the same way authboss's other storer interfaces work.
+type WebAuthnCredentialStorer interface {
+	LoadCredentials(ctx context.Context, userID string) ([]webauthn.Credential, error)
+	StoreCredential(ctx context.Context, userID string, cred webauthn.Credential) error
+}
+
+// webauthnUserAdapter upgrades a WebAuthnUser to the full webauthn.User
+// interface expected by github.com/go-webauthn/webauthn. It also prefers
+// WebAuthnCredentialStorer.LoadCredentials over the embedded WebAuthnUser's
+// own WebAuthnCredentials, since that storer is where RegisterWebAuthnFinishPost
+// actually persists newly-registered credentials.
+type webauthnUserAdapter struct {
+	WebAuthnUser
+	ctx    context.Context
+	storer WebAuthnCredentialStorer
+}
+
+func (a *HydraConsent) webAuthnUser(ctx context.Context, wu WebAuthnUser) webauthnUserAdapter {
+	return webauthnUserAdapter{WebAuthnUser: wu, ctx: ctx, storer: a.cfg.WebAuthnCredentialStorer}
+}
+
+func (w webauthnUserAdapter) WebAuthnDisplayName() string { return w.WebAuthnUser.WebAuthnName() }
+func (w webauthnUserAdapter) WebAuthnIcon() string        { return "" }
+
+func (w webauthnUserAdapter) WebAuthnCredentials() []webauthn.Credential {
+	if w.storer == nil {
+		return w.WebAuthnUser.WebAuthnCredentials()
+	}
+	creds, err := w.storer.LoadCredentials(w.ctx, w.WebAuthnUser.GetPID())
+	if err != nil || len(creds) == 0 {
+		return w.WebAuthnUser.WebAuthnCredentials()
+	}
+	return creds
+}
+
+func (a *HydraConsent) initWebAuthn() error {
+	if a.cfg.WebAuthnRPID == "" || a.cfg.WebAuthnRPOrigin == "" {
+		// WebAuthn is opt-in: without an RPID/origin configured we simply
+		// don't register the routes or the client.
+		return nil
+	}
+
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          a.cfg.WebAuthnRPID,
+		RPOrigins:     []string{a.cfg.WebAuthnRPOrigin},
+		RPDisplayName: a.cfg.WebAuthnDisplayName,
+	})
+	if err != nil {
+		return err
+	}
+	a.webauthn = wa
+
+	a.Authboss.Config.Core.Router.Post("/login/webauthn/begin", a.Authboss.Core.ErrorHandler.Wrap(a.LoginWebAuthnBeginPost))
+	a.Authboss.Config.Core.Router.Post("/login/webauthn/finish", a.Authboss.Core.ErrorHandler.Wrap(a.LoginWebAuthnFinishPost))
+	a.Authboss.Config.Core.Router.Post("/webauthn/register/begin", a.Authboss.Core.ErrorHandler.Wrap(a.RegisterWebAuthnBeginPost))
+	a.Authboss.Config.Core.Router.Post("/webauthn/register/finish", a.Authboss.Core.ErrorHandler.Wrap(a.RegisterWebAuthnFinishPost))
+
+	return nil
+}
+
+func (a *HydraConsent) loadWebAuthnUser(ctx context.Context, pid string) (WebAuthnUser, error) {
+	usr, err := a.Authboss.Storage.Server.Load(ctx, pid)
+	if err != nil {
+		return nil, err
+	}
+	wu, ok := usr.(WebAuthnUser)
+	if !ok {
+		return nil, authboss.ErrUserNotFound
+	}
+	return wu, nil
+}
+
+// LoginWebAuthnBeginPost generates a PublicKeyCredentialRequestOptions
+// challenge for a user trying to satisfy a Hydra login_challenge without a
+// password.
+func (a *HydraConsent) LoginWebAuthnBeginPost(w http.ResponseWriter, r *http.Request) error {
+	ch := r.URL.Query().Get("login_challenge")
+	if ch == "" {
+		ch = r.FormValue("login_challenge")
+	}
+	pid := r.FormValue("pid")
+
+	wu, err := a.loadWebAuthnUser(r.Context(), pid)
+	if err != nil {
+		return err
+	}
+
+	options, sessionData, err := a.webauthn.BeginLogin(a.webAuthnUser(r.Context(), wu))
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(sessionData)
+	if err != nil {
+		return err
+	}
+	authboss.PutSession(w, webauthnLoginSessionKeyPrefix+ch, string(raw))
+
+	return json.NewEncoder(w).Encode(options)
+}
+
+// LoginWebAuthnFinishPost verifies the client's assertion and, on success,
+// fires authboss.EventAuth so the existing EventAuth after-hook (which
+// calls hClient.AcceptLogin) runs exactly as it does for password logins.
+func (a *HydraConsent) LoginWebAuthnFinishPost(w http.ResponseWriter, r *http.Request) error {
+	ch := r.URL.Query().Get("login_challenge")
+	if ch == "" {
+		ch = r.FormValue("login_challenge")
+	}
+	pid := r.FormValue("pid")
+
+	raw, ok := authboss.GetSession(r, webauthnLoginSessionKeyPrefix+ch)
+	if !ok {
+		return authboss.ErrUserNotFound
+	}
+	var sessionData webauthn.SessionData
+	if err := json.Unmarshal([]byte(raw), &sessionData); err != nil {
+		return err
+	}
+
+	wu, err := a.loadWebAuthnUser(r.Context(), pid)
+	if err != nil {
+		return err
+	}
+
+	parsedResponse, err := protocol.ParseCredentialRequestResponse(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err = a.webauthn.ValidateLogin(a.webAuthnUser(r.Context(), wu), sessionData, parsedResponse); err != nil {
+		return err
+	}
+	authboss.DelSession(w, webauthnLoginSessionKeyPrefix+ch)
+
+	r = r.WithContext(context.WithValue(r.Context(), authboss.CTXKeyUser, wu))
+	r = r.WithContext(context.WithValue(r.Context(), ChallengeKey, ch))
+
+	authboss.PutSession(w, authboss.SessionKey, wu.GetPID())
+
+	handled, err := a.Authboss.Events.FireAfter(authboss.EventAuth, w, r)
+	if err != nil {
+		return err
+	} else if handled {
+		return nil
+	}
+
+	ro := authboss.RedirectOptions{
+		Code:             http.StatusTemporaryRedirect,
+		RedirectPath:     a.Authboss.Paths.AuthLoginOK,
+		FollowRedirParam: true,
+	}
+	return a.Authboss.Core.Redirector.Redirect(w, r, ro)
+}
+
+// RegisterWebAuthnBeginPost generates registration options for the
+// currently authenticated user.
+func (a *HydraConsent) RegisterWebAuthnBeginPost(w http.ResponseWriter, r *http.Request) error {
+	usr, err := a.Authboss.CurrentUser(r)
+	if err != nil {
+		return err
+	}
+	wu, ok := usr.(WebAuthnUser)
+	if !ok {
+		return authboss.ErrUserNotFound
+	}
+
+	options, sessionData, err := a.webauthn.BeginRegistration(a.webAuthnUser(r.Context(), wu))
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(sessionData)
+	if err != nil {
+		return err
+	}
+	authboss.PutSession(w, webauthnRegisterSessionKeyPrefix+wu.GetPID(), string(raw))
+
+	return json.NewEncoder(w).Encode(options)
+}
+
+// RegisterWebAuthnFinishPost verifies the attestation response and stores
+// the resulting credential via WebAuthnCredentialStorer.
+func (a *HydraConsent) RegisterWebAuthnFinishPost(w http.ResponseWriter, r *http.Request) error {
+	usr, err := a.Authboss.CurrentUser(r)
+	if err != nil {
+		return err
+	}
+	wu, ok := usr.(WebAuthnUser)
+	if !ok {
+		return authboss.ErrUserNotFound
+	}
+
+	raw, ok := authboss.GetSession(r, webauthnRegisterSessionKeyPrefix+wu.GetPID())
+	if !ok {
+		return authboss.ErrUserNotFound
+	}
+	var sessionData webauthn.SessionData
+	if err := json.Unmarshal([]byte(raw), &sessionData); err != nil {
+		return err
+	}
+
+	parsedResponse, err := protocol.ParseCredentialCreationResponse(r)
+	if err != nil {
+		return err
+	}
+
+	credential, err := a.webauthn.CreateCredential(a.webAuthnUser(r.Context(), wu), sessionData, parsedResponse)
+	if err != nil {
+		return err
+	}
+	authboss.DelSession(w, webauthnRegisterSessionKeyPrefix+wu.GetPID())
+
+	if a.cfg.WebAuthnCredentialStorer == nil {
+		return nil
+	}
+	return a.cfg.WebAuthnCredentialStorer.StoreCredential(r.Context(), wu.GetPID(), *credential)
+}